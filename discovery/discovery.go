@@ -0,0 +1,119 @@
+// Package discovery talks to an etcd discovery service (the public
+// discovery.etcd.io-style bootstrap endpoint, or a self-hosted equivalent) on
+// behalf of the join package: resolving the peer list and cluster size a new
+// member should bootstrap from, and storing the small amount of extra
+// bookkeeping (member liveness timestamps, add/remove claims) elastic-etcd
+// keeps alongside it.
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Machine is a cluster peer as published in the discovery service, together
+// with its derived client URL.
+type Machine struct {
+	Member client.Member
+}
+
+// NamedPeerURLs returns "name=peerURL" pairs for each of the machine's peer
+// URLs, in the format etcd's --initial-cluster flag expects.
+func (m Machine) NamedPeerURLs() []string {
+	named := make([]string, 0, len(m.Member.PeerURLs))
+	for _, u := range m.Member.PeerURLs {
+		named = append(named, fmt.Sprintf("%s=%s", m.Member.Name, u))
+	}
+	return named
+}
+
+// NewDiscoveryNode parses a "name=peerURL" discovery service value into a
+// Machine, deriving its client URL by substituting clientPort for the peer
+// URL's port.
+func NewDiscoveryNode(value string, clientPort int) (*Machine, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid discovery node value %q, expected name=peerURL", value)
+	}
+	name, peerURL := parts[0], parts[1]
+
+	u, err := url.Parse(peerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer url %q: %v", peerURL, err)
+	}
+
+	host := u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+	}
+
+	return &Machine{
+		Member: client.Member{
+			Name:       name,
+			PeerURLs:   []string{peerURL},
+			ClientURLs: []string{fmt.Sprintf("%s://%s:%d", u.Scheme, host, clientPort)},
+		},
+	}, nil
+}
+
+// keysAPI builds a client.KeysAPI for discoveryURL's endpoint, using transport
+// for the underlying HTTP connection, and returns the key prefix (the
+// discovery token path, e.g. "/1234...") to apply to every key passed to
+// Value/Set/Delete.
+func keysAPI(transport client.CancelableTransport, discoveryURL string) (client.KeysAPI, string, error) {
+	if transport == nil {
+		transport = client.DefaultTransport
+	}
+
+	u, err := url.Parse(discoveryURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid discovery url %q: %v", discoveryURL, err)
+	}
+	prefix := u.Path
+	u.Path = ""
+
+	c, err := client.New(client.Config{
+		Endpoints: []string{u.String()},
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return client.NewKeysAPI(c), prefix, nil
+}
+
+// Value reads key below discoveryURL's token, using transport for the
+// underlying connection (client.DefaultTransport when nil).
+func Value(ctx context.Context, transport client.CancelableTransport, discoveryURL, key string) (*client.Response, error) {
+	kapi, prefix, err := keysAPI(transport, discoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	return kapi.Get(ctx, prefix+key, nil)
+}
+
+// Set writes value to key below discoveryURL's token, using transport for the
+// underlying connection (client.DefaultTransport when nil).
+func Set(ctx context.Context, transport client.CancelableTransport, discoveryURL, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	kapi, prefix, err := keysAPI(transport, discoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	return kapi.Set(ctx, prefix+key, value, opts)
+}
+
+// Delete removes key below discoveryURL's token, using transport for the
+// underlying connection (client.DefaultTransport when nil).
+func Delete(ctx context.Context, transport client.CancelableTransport, discoveryURL, key string) (*client.Response, error) {
+	kapi, prefix, err := keysAPI(transport, discoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	return kapi.Delete(ctx, prefix+key, nil)
+}
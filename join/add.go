@@ -3,54 +3,197 @@ package join
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
-	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/coreos/etcd/client"
 	"github.com/golang/glog"
-	"github.com/sttts/elastic-etcd/node"
+	"github.com/sttts/elastic-etcd/discovery"
+	"golang.org/x/net/context"
 )
 
+// livenessKeyPrefix is where per-member last-seen-alive timestamps are kept in the
+// discovery etcd, so that removeDeadMember can require sustained unreachability
+// across re-invocations instead of evicting a member on a single failed probe.
+const livenessKeyPrefix = "/_elastic/liveness/"
+
+// defaultLivenessTTL bounds how long a liveness timestamp is kept when
+// RemoveDelay is 0, so entries don't accumulate forever in the discovery etcd
+// even when the sustained-unreachability feature isn't in use.
+const defaultLivenessTTL = time.Hour
+
+// probeWorkers bounds how many members are probed for liveness concurrently, so a
+// large cluster doesn't open hundreds of simultaneous connections.
+const probeWorkers = 8
+
+// claimKeyPrefix is where short-lived claims on unstarted member slots and on the
+// add-a-member critical section are kept in the discovery etcd, so that two
+// elastic-etcd processes racing to join the same cluster don't both succeed.
+const claimKeyPrefix = "/_elastic/claims/"
+
+// addSlotClaim serializes the "check cluster size, then add a member" critical
+// section across concurrent joiners.
+const addSlotClaim = "add-slot"
+
+// MemberAdder adds the local node to an existing cluster, following the configured Strategy.
 type MemberAdder struct {
-	mapi        client.MembersAPI
-	activeNodes []node.DiscoveryNode
-	strategy    Strategy
-	clientPort  int
-	targetSize  int
+	mapi         client.MembersAPI
+	activeNodes  []discovery.Machine
+	strategy     Strategy
+	clientPort   int
+	targetSize   int
+	discoveryURL string
+	tlsConfig    *TLSConfig
+	transport    client.CancelableTransport
+
+	// RemoveDelay is how long a member must be continuously unreachable, as tracked
+	// in the discovery etcd, before removeDeadMember will evict it. Zero means evict
+	// on the first failed probe.
+	RemoveDelay time.Duration
 }
 
-func NewMemberAdder(
-	activeNodes []node.DiscoveryNode,
+func newMemberAdder(
+	activeNodes []discovery.Machine,
 	strategy Strategy,
 	clientPort int,
 	targetSize int,
+	discoveryURL string,
+	removeDelay time.Duration,
+	tlsConfig *TLSConfig,
+	transport client.CancelableTransport,
 ) (*MemberAdder, error) {
 	activeUrls := make([]string, 0, len(activeNodes))
 	for _, an := range activeNodes {
-		activeUrls = append(activeUrls, an.ClientURLs...)
+		activeUrls = append(activeUrls, an.Member.ClientURLs...)
 	}
+	activeUrls = rewriteHTTPSAll(tlsConfig, activeUrls)
 
 	c, err := client.New(client.Config{
 		Endpoints:               activeUrls,
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: EtcdTimeout,
+		Transport:               transport,
+		HeaderTimeoutPerRequest: etcdTimeout,
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	return &MemberAdder{
-		mapi:        client.NewMembersAPI(c),
-		activeNodes: activeNodes,
-		strategy:    strategy,
-		clientPort:  clientPort,
-		targetSize:  targetSize,
+		mapi:         client.NewMembersAPI(c),
+		activeNodes:  activeNodes,
+		strategy:     strategy,
+		clientPort:   clientPort,
+		targetSize:   targetSize,
+		discoveryURL: discoveryURL,
+		tlsConfig:    tlsConfig,
+		transport:    transport,
+		RemoveDelay:  removeDelay,
 	}, nil
 }
 
+// markAlive records the current time as the last-seen-alive timestamp for memberID
+// in the discovery etcd. It is a no-op when there is no discovery etcd to record it
+// in (SRV discovery).
+func (ma *MemberAdder) markAlive(ctx context.Context, memberID string) {
+	if ma.discoveryURL == "" {
+		return
+	}
+
+	_, err := discovery.Set(ctx, ma.transport, ma.discoveryURL, livenessKeyPrefix+memberID, strconv.FormatInt(time.Now().Unix(), 10), &client.SetOptions{
+		TTL: ma.livenessTTL(),
+	})
+	if err != nil {
+		glog.Warningf("Cannot record liveness for member %s: %v", memberID, err)
+	}
+}
+
+// livenessTTL bounds how long a liveness timestamp survives in the discovery
+// etcd. It must outlast RemoveDelay itself: a shorter TTL would let a still-
+// unreachable member's timestamp expire and reset to "now" before the delay
+// elapses, so removeDeadMember would never evict it.
+func (ma *MemberAdder) livenessTTL() time.Duration {
+	if ma.RemoveDelay <= 0 {
+		return defaultLivenessTTL
+	}
+	return ma.RemoveDelay * 2
+}
+
+// pastRemoveDelay reports whether member m has been unreachable for at least
+// ma.RemoveDelay, based on the last-seen-alive timestamp stored in the discovery
+// etcd. A member with no stored timestamp is treated as first seen now, so it is
+// not yet eligible for removal. Without a discovery etcd to persist timestamps in
+// (SRV discovery) the delay cannot be tracked across invocations, so it is
+// treated as already elapsed.
+func (ma *MemberAdder) pastRemoveDelay(ctx context.Context, m client.Member) bool {
+	if ma.RemoveDelay <= 0 || ma.discoveryURL == "" {
+		return true
+	}
+
+	key := livenessKeyPrefix + m.ID
+	res, err := discovery.Value(ctx, ma.transport, ma.discoveryURL, key)
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeKeyNotFound {
+			ma.markAlive(ctx, m.ID)
+			return false
+		}
+		glog.Warningf("Cannot read liveness history for member %s, assuming past remove delay: %v", m.Name, err)
+		return true
+	}
+
+	seenAt, err := strconv.ParseInt(*res.Node.Value, 10, 64)
+	if err != nil {
+		glog.Warningf("Invalid liveness timestamp for member %s, assuming past remove delay: %v", m.Name, err)
+		return true
+	}
+
+	return time.Since(time.Unix(seenAt, 0)) >= ma.RemoveDelay
+}
+
+// claim acquires a short-lived, TTL-bounded lock on a discovery-etcd key via a
+// prevExist=false compare-and-swap, so that only one joiner proceeds through the
+// claimed section at a time. held is false, with a nil err, only when another
+// joiner already holds the claim (ErrorCodeNodeExist); release is a no-op in
+// that case. Any other error from the discovery etcd (timeout, network,
+// auth, ...) is propagated instead of being mistaken for contention, since
+// treating every backend hiccup as "another joiner holds it" would make Add
+// fail closed on transient discovery-etcd errors. A crashed holder's claim
+// simply expires after the TTL.
+//
+// When ma.discoveryURL is empty (SRV discovery has no KV backend to claim
+// against) claim is a no-op that always succeeds, so SRV-discovered joins are
+// not serialized against each other.
+func (ma *MemberAdder) claim(ctx context.Context, key string) (release func(), held bool, err error) {
+	if ma.discoveryURL == "" {
+		return func() {}, true, nil
+	}
+
+	full := claimKeyPrefix + key
+
+	_, err = discovery.Set(ctx, ma.transport, ma.discoveryURL, full, "1", &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       etcdTimeout * 2,
+	})
+	if err == nil {
+		return func() {
+			if _, err := discovery.Delete(ctx, ma.transport, ma.discoveryURL, full); err != nil {
+				glog.Warningf("Cannot release claim %s: %v", full, err)
+			}
+		}, true, nil
+	}
+
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+		glog.V(5).Infof("Cannot claim %s, another joiner holds it", full)
+		return func() {}, false, nil
+	}
+
+	return func() {}, false, fmt.Errorf("cannot claim %s: %v", full, err)
+}
+
 func (ma *MemberAdder) findUnstartedMember(
+	ctx context.Context,
 	members []client.Member,
 	urls []string,
-) *client.Member {
+) (*client.Member, func(), error) {
 	newUrls := map[string]struct{}{}
 	for _, u := range urls {
 		newUrls[u] = struct{}{}
@@ -68,11 +211,76 @@ findUnstartedMember:
 				continue findUnstartedMember
 			}
 		}
+
+		release, held, err := ma.claim(ctx, m.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !held {
+			glog.V(5).Infof("Unstarted member slot %s is already claimed by another joiner, skipping", m.ID)
+			continue
+		}
+
 		glog.Infof("Unstarted member %s with matching %v peer urls found", m.ID, m.PeerURLs)
-		return &m
+		return &m, release, nil
 	}
 
-	return nil
+	return nil, nil, nil
+}
+
+// memberProbe is a snapshot of one member's liveness, gathered concurrently by
+// probeMembers so that removeDeadMember can apply its selection logic without
+// blocking on each member in turn. protectQuorum probes its members
+// concurrently on its own and does not use memberProbe.
+type memberProbe struct {
+	member client.Member
+	alive  bool
+	active bool
+	err    error
+}
+
+// probeMembers checks alive/active status for all of members concurrently, bounded
+// by probeWorkers, and returns one memberProbe per member.
+func (ma *MemberAdder) probeMembers(ctx context.Context, members []client.Member) []memberProbe {
+	wg := sync.WaitGroup{}
+	wg.Add(len(members))
+	sem := make(chan struct{}, probeWorkers)
+	lock := sync.Mutex{}
+	probes := make([]memberProbe, len(members))
+	for i, m := range members {
+		go func(i int, m client.Member) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			p := memberProbe{member: m}
+			for _, u := range m.PeerURLs {
+				n, err := discovery.NewDiscoveryNode(fmt.Sprintf("%s=%s", m.Name, rewriteHTTPS(ma.tlsConfig, u)), ma.clientPort)
+				if err != nil {
+					p.err = err
+					break
+				}
+				if alive(ctx, ma.tlsConfig, ma.transport, n.Member) {
+					p.alive = true
+					isActive, err := active(ctx, ma.tlsConfig, ma.transport, n.Member)
+					if err != nil {
+						p.err = err
+						break
+					}
+					if isActive {
+						p.active = true
+						break
+					}
+				}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			probes[i] = p
+		}(i, m)
+	}
+	wg.Wait()
+	return probes
 }
 
 func (ma *MemberAdder) removeDeadMember(
@@ -80,30 +288,26 @@ func (ma *MemberAdder) removeDeadMember(
 	members []client.Member,
 ) (*client.Member, error) {
 	var selected *client.Member
-searchForDead:
-	for _, m := range members {
-		if len(m.PeerURLs) == 0 {
-			selected = &m
-			break
-		}
-		for _, u := range m.PeerURLs {
-			n, err := node.NewDiscoveryNode(fmt.Sprintf("%s=%s", m.Name, u), ma.clientPort)
-			if err != nil {
-				glog.Warningf("Invalid peer URL %s in member %s found", u, m.Name)
-				continue searchForDead
+	for _, p := range ma.probeMembers(ctx, members) {
+		m := p.member
+
+		if len(m.PeerURLs) != 0 {
+			if p.err != nil {
+				glog.Warningf("Invalid peer URL or health check error for member %s found: %v", m.Name, p.err)
+				continue
 			}
-			if alive(ctx, n.Member) {
-				isActive, err := active(ctx, n.Member)
-				if err != nil {
-					glog.Warningf("Error checking member %s health", m.Name)
-					continue searchForDead
-				}
-				if isActive {
-					glog.V(5).Infof("Member %v found to be alive and active", n.NamedPeerUrls())
-					continue searchForDead
-				}
+			if p.alive && p.active {
+				glog.V(5).Infof("Member %v found to be alive and active", m.PeerURLs)
+				ma.markAlive(ctx, m.ID)
+				continue
 			}
 		}
+
+		if !ma.pastRemoveDelay(ctx, m) {
+			glog.V(5).Infof("Member %s looks dead but has not been unreachable for the %s remove delay yet", m.Name, ma.RemoveDelay)
+			continue
+		}
+
 		selected = &m
 		break
 	}
@@ -128,18 +332,41 @@ func (ma *MemberAdder) protectQuorum(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+
 	startedMembers := 0
-	healthyMembers := 0
 	for _, m := range ms {
 		if m.Name != "" {
 			startedMembers++
 		}
-		if alive(ctx, m) {
-			if isActive, err := active(ctx, m); isActive && err == nil {
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(ms))
+	sem := make(chan struct{}, probeWorkers)
+	lock := sync.Mutex{}
+	healthyMembers := 0
+	for _, m := range ms {
+		go func(m client.Member) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			healthy := false
+			if alive(ctx, ma.tlsConfig, ma.transport, m) {
+				if isActive, err := active(ctx, ma.tlsConfig, ma.transport, m); isActive && err == nil {
+					healthy = true
+				}
+			}
+
+			if healthy {
+				lock.Lock()
 				healthyMembers++
+				lock.Unlock()
 			}
-		}
+		}(m)
 	}
+	wg.Wait()
+
 	futureQuorum := (startedMembers+1)/2 + 1
 	if healthyMembers < futureQuorum {
 		return fmt.Errorf("cannot add another member temporarily to the %d member "+
@@ -156,7 +383,7 @@ func (ma *MemberAdder) Add(
 	name string,
 	urls []string,
 ) ([]string, error) {
-	ctx, _ = context.WithTimeout(ctx, EtcdTimeout)
+	ctx, _ = context.WithTimeout(ctx, etcdTimeout)
 
 	glog.V(4).Info("Getting cluster members")
 	ms, err := ma.mapi.List(ctx)
@@ -164,8 +391,13 @@ func (ma *MemberAdder) Add(
 		return nil, err
 	}
 
-	unstarted := ma.findUnstartedMember(ms, urls)
+	unstarted, release, err := ma.findUnstartedMember(ctx, ms, urls)
+	if err != nil {
+		return nil, err
+	}
 	if unstarted != nil {
+		defer release()
+
 		glog.Infof("Found matching member entry %s=%v, no need to add", unstarted.Name, unstarted.PeerURLs)
 
 		if err := ma.protectQuorum(ctx); err != nil {
@@ -175,6 +407,24 @@ func (ma *MemberAdder) Add(
 		return unstarted.PeerURLs, nil
 	}
 
+	release, held, err := ma.claim(ctx, addSlotClaim)
+	if err != nil {
+		return nil, err
+	}
+	if !held {
+		return nil, errors.New("another joiner is already adding a member to this cluster, try again")
+	}
+	defer release()
+
+	// Re-list now that we hold the add-slot claim: membership may have changed
+	// since the listing above, and every decision below (which dead member
+	// to remove, whether the cluster is already full) must be made against
+	// up-to-date members, not the pre-claim snapshot.
+	ms, err = ma.mapi.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	switch ma.strategy {
 	case ReplaceStrategy:
 		removed, err := ma.removeDeadMember(ctx, ms)
@@ -0,0 +1,118 @@
+package join
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/glog"
+	"github.com/sttts/elastic-etcd/discovery"
+	"golang.org/x/net/context"
+)
+
+// discoverySRVService is the SRV service name etcd itself resolves for peer
+// discovery, mirroring etcd's own SRVGetCluster.
+const discoverySRVService = "etcd-server"
+
+// Discoverer resolves the initial peer list and target cluster size for a join
+// attempt, abstracting over where that information comes from.
+type Discoverer interface {
+	// Machines returns the machines currently known to the discovery backend.
+	Machines(ctx context.Context, clientPort int) ([]discovery.Machine, error)
+
+	// Size returns the target cluster size, resolving it from the backend when
+	// clusterSize is negative and expanding the "no limit" sentinel of 0. A
+	// backend that holds no size of its own returns an error for a negative
+	// clusterSize.
+	Size(ctx context.Context, clusterSize int) (int, error)
+}
+
+// etcdKVDiscoverer resolves peers and cluster size from an etcd discovery URL,
+// i.e. the long-standing --discovery behaviour of Join. transport is built
+// once by the caller and shared with every other discovery/liveness call.
+type etcdKVDiscoverer struct {
+	discoveryURL string
+	transport    client.CancelableTransport
+}
+
+func (d *etcdKVDiscoverer) Machines(ctx context.Context, clientPort int) ([]discovery.Machine, error) {
+	res, err := discovery.Value(ctx, d.transport, d.discoveryURL, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]discovery.Machine, 0, len(res.Node.Nodes))
+	for _, nn := range res.Node.Nodes {
+		if nn.Value == nil {
+			glog.V(5).Infof("Skipping %q because no value exists", nn.Key)
+			continue
+		}
+		n, err := discovery.NewDiscoveryNode(*nn.Value, clientPort)
+		if err != nil {
+			glog.Warningf("invalid peer url %q in discovery service: %v", *nn.Value, err)
+			continue
+		}
+		nodes = append(nodes, *n)
+	}
+	return nodes, nil
+}
+
+func (d *etcdKVDiscoverer) Size(ctx context.Context, clusterSize int) (int, error) {
+	if clusterSize > 0 {
+		return clusterSize, nil
+	}
+	if clusterSize == 0 {
+		return maxInt, nil
+	}
+
+	res, err := discovery.Value(ctx, d.transport, d.discoveryURL, "/_config/size")
+	if err != nil {
+		return 0, fmt.Errorf("cannot get discovery url cluster size: %v", err)
+	}
+
+	size, _ := strconv.ParseInt(*res.Node.Value, 10, 16)
+	glog.V(2).Infof("Got a target cluster size of %d from the discovery url", size)
+	return int(size), nil
+}
+
+// srvDiscoverer resolves peers by looking up _etcd-server._tcp.<domain> SRV
+// records, for environments (Kubernetes headless Services, Consul DNS, ...)
+// where running a bootstrap discovery endpoint is undesirable.
+type srvDiscoverer struct {
+	domain string
+}
+
+func (d *srvDiscoverer) Machines(ctx context.Context, clientPort int) ([]discovery.Machine, error) {
+	_, addrs, err := net.LookupSRV(discoverySRVService, "tcp", d.domain)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve SRV records for %q: %v", d.domain, err)
+	}
+
+	nodes := make([]discovery.Machine, 0, len(addrs))
+	for _, addr := range addrs {
+		target := strings.TrimSuffix(addr.Target, ".")
+		name := strings.SplitN(target, ".", 2)[0]
+		peerURL := fmt.Sprintf("http://%s:%d", target, addr.Port)
+
+		n, err := discovery.NewDiscoveryNode(fmt.Sprintf("%s=%s", name, peerURL), clientPort)
+		if err != nil {
+			glog.Warningf("invalid SRV target %q for %s: %v", target, d.domain, err)
+			continue
+		}
+		nodes = append(nodes, *n)
+	}
+	return nodes, nil
+}
+
+func (d *srvDiscoverer) Size(ctx context.Context, clusterSize int) (int, error) {
+	if clusterSize < 0 {
+		return 0, errors.New("--discovery-srv has no /_config/size equivalent; pass an explicit --size")
+	}
+	if clusterSize == 0 {
+		return maxInt, nil
+	}
+	return clusterSize, nil
+}
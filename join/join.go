@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -36,6 +35,10 @@ const (
 	// AddStrategy only adds a member until the cluster is full, never removes old members.
 	AddStrategy = Strategy("add")
 
+	// StandbyStrategy caps the voting membership at clusterSize and runs any extra
+	// node as a read-only proxy (etcd proxy mode) instead of adding it as a member.
+	StandbyStrategy = Strategy("standby")
+
 	maxUint = ^uint(0)
 	maxInt  = int(maxUint >> 1)
 )
@@ -46,14 +49,28 @@ type EtcdConfig struct {
 	InitialClusterState string
 	AdvertisePeerURLs   string
 	Discovery           string
+	DiscoverySRV        string
 	Name                string
+
+	// ProxyMode is "on" when this node should run as an etcd proxy (read-only,
+	// non-voting) instead of a full member, and "off" when StandbyStrategy joins
+	// an existing cluster as a full member. It is left empty for every other
+	// strategy, and for StandbyStrategy too when the cluster is down or a new
+	// cluster is launched.
+	ProxyMode string
 }
 
-func alive(ctx context.Context, m client.Member) bool {
+// alive probes m's peer URLs for liveness using transport, which callers build
+// once up front (via buildTransport) and share across every probe, rather than
+// re-loading certificates from disk per call.
+func alive(ctx context.Context, tlsConfig *TLSConfig, transport client.CancelableTransport, m client.Member) bool {
 	ctx, _ = context.WithTimeout(ctx, livenessTimeout)
 	glog.V(6).Infof("Testing liveness of %s=%v", m.Name, m.PeerURLs)
+
+	httpClient := &http.Client{Transport: transport}
+
 	for _, u := range m.PeerURLs {
-		resp, err := ctxhttp.Get(ctx, http.DefaultClient, u+rafthttp.ProbingPrefix)
+		resp, err := ctxhttp.Get(ctx, httpClient, rewriteHTTPS(tlsConfig, u)+rafthttp.ProbingPrefix)
 		if err == nil && resp.StatusCode == http.StatusOK {
 			return true
 		}
@@ -62,12 +79,14 @@ func alive(ctx context.Context, m client.Member) bool {
 	return false
 }
 
-func active(ctx context.Context, m client.Member) (bool, error) {
+// active reports whether m knows a cluster leader, using the shared transport
+// (see alive).
+func active(ctx context.Context, tlsConfig *TLSConfig, transport client.CancelableTransport, m client.Member) (bool, error) {
 	ctx, _ = context.WithTimeout(ctx, etcdTimeout)
 
 	c, err := client.New(client.Config{
-		Endpoints:               m.ClientURLs,
-		Transport:               client.DefaultTransport,
+		Endpoints:               rewriteHTTPSAll(tlsConfig, m.ClientURLs),
+		Transport:               transport,
 		HeaderTimeoutPerRequest: 5 * time.Second,
 	})
 	if err != nil {
@@ -84,6 +103,8 @@ func active(ctx context.Context, m client.Member) (bool, error) {
 
 func clusterExistingHeuristic(
 	ctx context.Context,
+	tlsConfig *TLSConfig,
+	transport client.CancelableTransport,
 	size int, nodes []discovery.Machine,
 ) ([]discovery.Machine, error) {
 	quorum := size/2 + 1
@@ -100,11 +121,11 @@ func clusterExistingHeuristic(
 	for _, n := range nodes {
 		go func(n discovery.Machine) {
 			defer wg.Done()
-			if !alive(ctx, n.Member) {
+			if !alive(ctx, tlsConfig, transport, n.Member) {
 				glog.Infof("Node %s looks dead", n.NamedPeerURLs())
 				return
 			}
-			if ok, err := active(ctx, n.Member); !ok {
+			if ok, err := active(ctx, tlsConfig, transport, n.Member); !ok {
 				if err != nil {
 					glog.Error(err)
 				}
@@ -142,46 +163,42 @@ func clusterExistingHeuristic(
 
 // Join adds a new member depending on the strategy and returns a matching etcd configuration.
 func Join(
-	discoveryURL, name, initialAdvertisePeerURLs string,
+	discoveryURL, discoverySRV, name, initialAdvertisePeerURLs string,
 	fresh bool,
 	clientPort, clusterSize int,
 	strategy Strategy,
+	removeDelay time.Duration,
+	tlsConfig *TLSConfig,
 ) (*EtcdConfig, error) {
 	ctx := context.Background()
 
-	res, err := discovery.Value(ctx, discoveryURL, "/")
+	// Built once and shared by the discoverer, alive/active probing and the
+	// MemberAdder below, instead of every probe re-loading certificates from
+	// disk. A failure here is a hard error: it must not be mistaken for "peer
+	// is dead" by alive/active, which would get a healthy member evicted.
+	transport, err := buildTransport(tlsConfig)
 	if err != nil {
-		return nil, err
-	}
-	nodes := make([]discovery.Machine, 0, len(res.Node.Nodes))
-	for _, nn := range res.Node.Nodes {
-		if nn.Value == nil {
-			glog.V(5).Infof("Skipping %q because no value exists", nn.Key)
-		}
-		var n *discovery.Machine
-		n, err = discovery.NewDiscoveryNode(*nn.Value, clientPort)
-		if err != nil {
-			glog.Warningf("invalid peer url %q in discovery service: %v", *nn.Value, err)
-			continue
-		}
-		nodes = append(nodes, *n)
+		return nil, fmt.Errorf("cannot build TLS transport: %v", err)
 	}
 
-	if clusterSize < 0 {
-		res, err = discovery.Value(ctx, discoveryURL, "/_config/size")
-		if err != nil {
-			return nil, fmt.Errorf("cannot get discovery url cluster size: %v", err)
-		}
+	var discoverer Discoverer
+	if discoveryURL == "" && discoverySRV != "" {
+		discoverer = &srvDiscoverer{domain: discoverySRV}
+	} else {
+		discoverer = &etcdKVDiscoverer{discoveryURL: discoveryURL, transport: transport}
+	}
 
-		size, _ := strconv.ParseInt(*res.Node.Value, 10, 16)
-		clusterSize = int(size)
+	nodes, err := discoverer.Machines(ctx, clientPort)
+	if err != nil {
+		return nil, err
+	}
 
-		glog.V(2).Infof("Got a target cluster size of %d from the discovery url", clusterSize)
-	} else if clusterSize == 0 {
-		clusterSize = maxInt
+	clusterSize, err = discoverer.Size(ctx, clusterSize)
+	if err != nil {
+		return nil, err
 	}
 
-	activeNodes, err := clusterExistingHeuristic(ctx, clusterSize, nodes)
+	activeNodes, err := clusterExistingHeuristic(ctx, tlsConfig, transport, clusterSize, nodes)
 	if err != nil {
 		return nil, err
 	}
@@ -212,7 +229,26 @@ func Join(
 			advertisedNamedURLs = append(advertisedNamedURLs, fmt.Sprintf("%s=%s", name, u))
 		}
 
+		if strategy == StandbyStrategy && len(activeNodes) >= clusterSize {
+			glog.Infof(
+				"Cluster already has %d of %d members alive. Joining as a standby proxy instead of a voting member.",
+				len(activeNodes), clusterSize,
+			)
+
+			return &EtcdConfig{
+				InitialCluster:      activeNamedURLs,
+				InitialClusterState: "existing",
+				AdvertisePeerURLs:   initialAdvertisePeerURLs,
+				Name:                name,
+				ProxyMode:           "on",
+			}, nil
+		}
+
 		initialNamedURLs := []string{advertisedNamedURLs[0]}
+		proxyMode := ""
+		if strategy == StandbyStrategy {
+			proxyMode = "off"
+		}
 		if strategy != PreparedStrategy && fresh {
 			glog.Infof("Existing cluster found. Trying to join with %q strategy.", string(strategy))
 
@@ -222,6 +258,9 @@ func Join(
 				clientPort,
 				clusterSize,
 				discoveryURL,
+				removeDelay,
+				tlsConfig,
+				transport,
 			)
 			if err != nil {
 				return nil, err
@@ -244,15 +283,21 @@ func Join(
 			InitialClusterState: "existing",
 			AdvertisePeerURLs:   initialAdvertisePeerURLs,
 			Name:                name,
+			ProxyMode:           proxyMode,
 		}, nil
 	} else {
 		glog.Infof("Trying to launch new cluster.")
 
-		return &EtcdConfig{
+		cfg := &EtcdConfig{
 			InitialClusterState: "new",
-			Discovery:           discoveryURL,
 			AdvertisePeerURLs:   initialAdvertisePeerURLs,
 			Name:                name,
-		}, nil
+		}
+		if discoveryURL == "" && discoverySRV != "" {
+			cfg.DiscoverySRV = discoverySRV
+		} else {
+			cfg.Discovery = discoveryURL
+		}
+		return cfg, nil
 	}
 }
@@ -0,0 +1,103 @@
+package join
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+)
+
+// TLSConfig carries the certificate material used to talk to cluster members,
+// the discovery service and the peer-to-peer liveness probes. CA file, cert
+// file and key file mirror etcdctl's own --ca-file/--cert-file/--key-file
+// flags. When any of the peer equivalents is set, the peer triple replaces the
+// client triple for every connection, client and discovery ones included; the
+// two triples are never used side by side.
+type TLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	PeerCAFile   string
+	PeerCertFile string
+	PeerKeyFile  string
+}
+
+// peerOrClient returns the peer cert/key/CA triple when any of it is set, and
+// falls back to the client triple otherwise.
+func (t *TLSConfig) peerOrClient() (caFile, certFile, keyFile string) {
+	if t == nil {
+		return "", "", ""
+	}
+	if t.PeerCAFile != "" || t.PeerCertFile != "" || t.PeerKeyFile != "" {
+		return t.PeerCAFile, t.PeerCertFile, t.PeerKeyFile
+	}
+	return t.CAFile, t.CertFile, t.KeyFile
+}
+
+// enabled reports whether any certificate material was configured at all.
+func (t *TLSConfig) enabled() bool {
+	if t == nil {
+		return false
+	}
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" ||
+		t.PeerCAFile != "" || t.PeerCertFile != "" || t.PeerKeyFile != ""
+}
+
+// buildTransport builds the single *http.Transport shared by discovery.Value,
+// alive, active and MemberAdder, using tlsConfig's peer certificate material
+// when any of it is set and its client material otherwise (see peerOrClient),
+// and falling back to client.DefaultTransport when tlsConfig is nil or empty.
+func buildTransport(tlsConfig *TLSConfig) (client.CancelableTransport, error) {
+	if !tlsConfig.enabled() {
+		return client.DefaultTransport, nil
+	}
+
+	caFile, certFile, keyFile := tlsConfig.peerOrClient()
+
+	cfg := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load TLS client cert/key: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read TLS CA file %q: %v", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return &http.Transport{TLSClientConfig: cfg}, nil
+}
+
+// rewriteHTTPS turns an http:// endpoint into https:// once any TLS material (a
+// CA, cert or key file, client or peer) is configured, so that callers don't need to know the discovered member URLs
+// were written down before TLS was enabled on the cluster.
+func rewriteHTTPS(tlsConfig *TLSConfig, url string) string {
+	if !tlsConfig.enabled() {
+		return url
+	}
+	return strings.Replace(url, "http://", "https://", 1)
+}
+
+func rewriteHTTPSAll(tlsConfig *TLSConfig, urls []string) []string {
+	rewritten := make([]string, len(urls))
+	for i, u := range urls {
+		rewritten[i] = rewriteHTTPS(tlsConfig, u)
+	}
+	return rewritten
+}